@@ -4,17 +4,38 @@
 //   var myPage = pages.Add("/uri", myHandler, "tmpl/base.tmpl", "tmpl/page.tmpl")
 //
 //   func myHandler(w http.ResponseWriter, r *http.Request) pages.Result {
-//     return pages.OK("some data to page.tmpl")
+//     return pages.OK(map[string]interface{}{"Content": "some data to page.tmpl"})
 //   }
 //
 //   http.Handle(myPage.URI, myPage)
+//
+// Pages may also be loaded from an fs.FS (including an embed.FS embedded
+// into the binary) via NewServer:
+//
+//   var srv = pages.NewServer(templateFS, pages.DevMode())
+//   var myPage = srv.Add("/uri", myHandler, "tmpl/base.tmpl", "tmpl/page.tmpl")
+//
+// Handlers that would rather return an error than construct a Result can
+// implement pages.HandlerFunc instead, and rely on errors.Is to compose
+// with pages.ErrNotFound and friends:
+//
+//   var myPage pages.HandlerFunc = func(w http.ResponseWriter, r *http.Request) error {
+//     if !found {
+//       return pages.ErrNotFound
+//     }
+//     return nil
+//   }
 package pages // import "hkjn.me/pages"
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"net/http"
 	"net/url"
+	"sync"
 )
 
 var (
@@ -25,16 +46,193 @@ var (
 	StatusUnauthorized  = Result{responseCode: http.StatusUnauthorized}
 	StatusNotFound      = Result{responseCode: http.StatusNotFound}
 	StatusInternalError = Result{responseCode: http.StatusInternalServerError}
+
+	// errorTemplates holds the templates registered with SetErrorTemplate,
+	// keyed by HTTP status code. Guarded by errorTemplatesMu, since it may
+	// be written and read concurrently from serving goroutines.
+	errorTemplates   = map[int]*template.Template{}
+	errorTemplatesMu sync.RWMutex
 )
 
+// ErrorParams is the data passed to a template registered with
+// SetErrorTemplate.
+type ErrorParams struct {
+	Code    int    // HTTP status code
+	Message string // short, user-facing message
+	Details string // additional detail, if any; may be empty
+}
+
+// SetErrorTemplate registers tmpl to render error responses with the
+// given HTTP status code, replacing the plain-text fallback. tmpl is
+// invoked the same way as a page template, with an ErrorParams as its
+// data.
+func SetErrorTemplate(code int, tmpl *template.Template) {
+	errorTemplatesMu.Lock()
+	errorTemplates[code] = tmpl
+	errorTemplatesMu.Unlock()
+}
+
+// showErrorPage writes the error response for code, rendering it through
+// the template registered with SetErrorTemplate, if any, falling back to
+// the standard library's plain-text behavior otherwise.
+func showErrorPage(w http.ResponseWriter, r *http.Request, code int, msg, details string) {
+	errorTemplatesMu.RLock()
+	tmpl, ok := errorTemplates[code]
+	errorTemplatesMu.RUnlock()
+	if !ok {
+		if code == http.StatusNotFound {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, msg, code)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	ep := ErrorParams{Code: code, Message: msg, Details: details}
+	if err := tmpl.ExecuteTemplate(&buf, BaseTemplate, ep); err != nil {
+		logger(r).Errorf("Failed to render error template for %d: %v\n", code, err)
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	buf.WriteTo(w)
+}
+
 // Renderer is a function to render a page result.
 type Renderer func(w http.ResponseWriter, r *http.Request) Result
 
+// Sentinel errors recognized by HandlerFunc. Wrap one with
+// fmt.Errorf("...: %w", pages.ErrNotFound) to attach context while
+// keeping it discoverable with errors.Is.
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+)
+
+// HandlerFunc is an alternative to Renderer for handlers that would
+// rather return a plain error than construct a Result. It implements
+// http.Handler directly: ErrBadRequest, ErrUnauthorized, ErrNotFound
+// (or an error wrapping one of them) are mapped to the matching status
+// code and error template, and any other error becomes a 500.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// statusFor maps an error returned by a HandlerFunc to the HTTP status
+// code it should render as.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// messageFor returns the generic, user-facing message for code, matching
+// the strings ServeHTTP shows for the equivalent Result responses.
+func messageFor(code int) string {
+	switch code {
+	case http.StatusNotFound:
+		return "Not found"
+	case http.StatusBadRequest:
+		return "Bad request"
+	case http.StatusUnauthorized:
+		return "Unauthorized"
+	default:
+		return "Internal server error."
+	}
+}
+
+// PublicError pairs an error with a Message that's safe to show to
+// users, analogous to CaseError.Msg. Wrap a lower-level error (which may
+// contain details like DB errors or file paths) in a PublicError before
+// returning it from a HandlerFunc, rather than letting the raw error
+// text reach the response body.
+type PublicError struct {
+	Err     error
+	Message string
+}
+
+func (e *PublicError) Error() string { return e.Err.Error() }
+func (e *PublicError) Unwrap() error { return e.Err }
+
+// bufferingResponseWriter buffers a response so ServeHTTP can discard it
+// if the wrapped HandlerFunc returns an error, the same way Page.ServeHTTP
+// buffers template execution, instead of leaving partial output in front
+// of the error page.
+type bufferingResponseWriter struct {
+	header     http.Header
+	buf        bytes.Buffer
+	statusCode int
+}
+
+func newBufferingResponseWriter() *bufferingResponseWriter {
+	return &bufferingResponseWriter{header: http.Header{}, statusCode: http.StatusOK}
+}
+
+func (b *bufferingResponseWriter) Header() http.Header { return b.header }
+
+func (b *bufferingResponseWriter) Write(p []byte) (int, error) { return b.buf.Write(p) }
+
+func (b *bufferingResponseWriter) WriteHeader(code int) { b.statusCode = code }
+
+// ServeHTTP implements http.Handler by calling h against a buffered
+// ResponseWriter and, on error, mapping it to a status code and
+// rendering it through the pluggable error-page renderer. On success,
+// the buffered response is flushed to w.
+func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bw := newBufferingResponseWriter()
+	err := h(bw, r)
+	if err != nil {
+		code := statusFor(err)
+		logger(r).Errorf("Error while handling %v: %v\n", r.URL, err)
+		msg := messageFor(code)
+		var pe *PublicError
+		if errors.As(err, &pe) {
+			msg = pe.Message
+		}
+		showErrorPage(w, r, code, msg, "")
+		return
+	}
+	for k, vs := range bw.header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(bw.statusCode)
+	bw.buf.WriteTo(w)
+}
+
+// CaseError is a single request-validation rule: Validator reports
+// whether r violates the rule, and Msg returns the user-facing message
+// to show when it does.
+type CaseError struct {
+	Validator func(r *http.Request) bool
+	Msg       func(r *http.Request) string
+}
+
+// firstMatchingValidator returns a pointer to the first CaseError in vs
+// whose Validator matches r, or nil if none do.
+func firstMatchingValidator(r *http.Request, vs []CaseError) *CaseError {
+	for i := range vs {
+		if vs[i].Validator(r) {
+			return &vs[i]
+		}
+	}
+	return nil
+}
+
 // A Page to be rendered.
 type Page struct {
-	URI    string             // URI path
-	Render Renderer           // func to render the page
-	tmpl   *template.Template // backing template
+	URI        string             // URI path
+	Render     Renderer           // func to render the page
+	tmpl       *template.Template // backing template
+	validators []CaseError        // checked, in order, before Render is called
+	server     *Server            // Server p was created from, if any
+	tmpls      []string           // template names passed to ParseFS, for reparsing in DevMode
 }
 
 // Add creates a new page.
@@ -49,6 +247,103 @@ func Add(uri string, render Renderer, tmpls ...string) Page {
 	}
 }
 
+// WithValidators returns a copy of p that checks each of vs, in order,
+// before calling p.Render. The first validator whose Validator matches
+// the request stops evaluation and its Msg is shown as a bad request.
+func (p Page) WithValidators(vs ...CaseError) Page {
+	p.validators = vs
+	return p
+}
+
+// Use returns a copy of p with mw wrapped around p.Render, so
+// cross-cutting concerns (auth checks, metrics, ...) can be composed
+// once instead of duplicated in every handler. Middlewares added via Use
+// run outermost-last, i.e. the last Use call wraps all the others.
+func (p Page) Use(mw func(Renderer) Renderer) Page {
+	p.Render = mw(p.Render)
+	return p
+}
+
+// PageContext holds fields common to every page, merged automatically
+// into the template data returned by OK when it doesn't already set
+// them.
+type PageContext struct {
+	User    string // current user, if any
+	Version string // app version
+	Path    string // request path
+	CSRF    string // CSRF token, if any
+}
+
+// PageContextFor derives the PageContext for a request. Replace it to
+// wire in the current user, app version or CSRF token.
+var PageContextFor = func(r *http.Request) PageContext {
+	return PageContext{Path: r.URL.Path}
+}
+
+// mergeContext fills in User, Version, Path and CSRF keys in data from
+// pc, without overwriting any the handler already set.
+func mergeContext(data map[string]interface{}, pc PageContext) {
+	fields := map[string]string{
+		"User":    pc.User,
+		"Version": pc.Version,
+		"Path":    pc.Path,
+		"CSRF":    pc.CSRF,
+	}
+	for k, v := range fields {
+		if _, ok := data[k]; !ok {
+			data[k] = v
+		}
+	}
+}
+
+// A Server owns a set of Pages whose templates are loaded from a single
+// fs.FS, such as an embed.FS embedded into the binary for production, or
+// os.DirFS("tmpl") for local development.
+type Server struct {
+	fsys    fs.FS
+	DevMode bool // if true, re-parse templates from fsys on every request
+
+	mu sync.Mutex // guards template parsing, shared with any Pages in DevMode
+}
+
+// NewServer creates a Server that loads page templates from fsys.
+func NewServer(fsys fs.FS, opts ...ServerOption) *Server {
+	s := &Server{fsys: fsys}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// A ServerOption configures a Server created by NewServer.
+type ServerOption func(*Server)
+
+// DevMode makes the Server re-parse page templates from its fs.FS on
+// every request, so template edits are picked up without restarting the
+// binary.
+func DevMode() ServerOption {
+	return func(s *Server) { s.DevMode = true }
+}
+
+// Add creates a new page whose templates are parsed from s's fs.FS.
+//
+// Add panics if the page templates cannot be parsed.
+func (s *Server) Add(uri string, render Renderer, tmpls ...string) Page {
+	t := template.Must(template.ParseFS(s.fsys, tmpls...))
+	return Page{
+		URI:    uri,
+		tmpl:   t,
+		Render: render,
+		server: s,
+		tmpls:  tmpls,
+	}
+}
+
+// Handle registers p to serve its URI on mux.
+func (s *Server) Handle(mux *http.ServeMux, p Page) {
+	mux.Handle(p.URI, p)
+}
+
 // Result is the result of rendering a page.
 type Result struct {
 	data         interface{} // data to render the page
@@ -65,6 +360,18 @@ func StatusOK(data interface{}) Result {
 	}
 }
 
+// OK returns http.StatusOK with given map passed to the template. Maps
+// returned this way (whether from OK or StatusOK) are auto-filled with
+// the request's PageContext (user, version, path, CSRF token) by
+// ServeHTTP, so handlers only need to set the fields specific to their
+// page.
+func OK(data map[string]interface{}) Result {
+	return Result{
+		responseCode: http.StatusOK,
+		data:         data,
+	}
+}
+
 // BadRequestWith returns a Result indicating a bad request.
 func BadRequestWith(err error) Result {
 	return Result{
@@ -133,32 +440,64 @@ func (p Page) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c := logger(r)
 	c.Infof("Page %+v will ServeHTTP for URL: %v", p, r.URL)
 
+	// Run registered validators in order, stopping at the first match, so
+	// callers get a specific hint instead of the static BadRequestMsg.
+	if v := firstMatchingValidator(r, p.validators); v != nil {
+		msg := v.Msg(r)
+		c.Errorf("Request failed validation for %v: %s\n", r.URL, msg)
+		showErrorPage(w, r, http.StatusBadRequest, msg, "")
+		return
+	}
+
 	// Render the page, retrieving any data for the template.
 	pr := p.Render(w, r)
 	if pr.err != nil || pr.responseCode != http.StatusOK {
 		if pr.err != nil {
 			c.Errorf("Error while rendering %v: %v\n", r.URL, pr.err)
 		}
-		if pr.responseCode == http.StatusNotFound {
-			http.NotFound(w, r)
-		} else if pr.responseCode == http.StatusBadRequest {
-			http.Error(w, "Bad request", http.StatusBadRequest)
-		} else if pr.responseCode == http.StatusSeeOther {
+		switch pr.responseCode {
+		case http.StatusNotFound:
+			showErrorPage(w, r, http.StatusNotFound, "Not found", "")
+		case http.StatusBadRequest:
+			showErrorPage(w, r, http.StatusBadRequest, "Bad request", "")
+		case http.StatusUnauthorized:
+			showErrorPage(w, r, http.StatusUnauthorized, "Unauthorized", "")
+		case http.StatusSeeOther:
 			http.Redirect(w, r, pr.next, http.StatusSeeOther)
-		} else {
-			http.Error(w, "Internal server error.", pr.responseCode)
+		default:
+			showErrorPage(w, r, http.StatusInternalServerError, "Internal server error.", "")
 		}
 		return
 	}
 
-	err := p.tmpl.ExecuteTemplate(w, BaseTemplate, pr.data)
-	if err != nil {
-		// TODO: If this happens, partial template data is still written
-		// to w by ExecuteTemplate, which isn't ideal; we'd like the 500
-		// to be the only thing returned to viewing user.
+	if data, ok := pr.data.(map[string]interface{}); ok {
+		mergeContext(data, PageContextFor(r))
+	}
+
+	tmpl := p.tmpl
+	if p.server != nil && p.server.DevMode {
+		p.server.mu.Lock()
+		t, err := template.ParseFS(p.server.fsys, p.tmpls...)
+		p.server.mu.Unlock()
+		if err != nil {
+			c.Errorf("Failed to re-parse templates for %v: %v\n", r.URL, err)
+			showErrorPage(w, r, http.StatusInternalServerError, "Internal server error.", "")
+			return
+		}
+		tmpl = t
+	}
 
+	// Render into a buffer first, so a failing ExecuteTemplate can never
+	// leave partial output in front of the 500 response.
+	var buf bytes.Buffer
+	err := tmpl.ExecuteTemplate(&buf, BaseTemplate, pr.data)
+	if err != nil {
 		// Error rendering the template is a programming bug.
 		c.Errorf("Failed to render template: %v", err)
-		http.Error(w, "Internal server error.", http.StatusInternalServerError)
+		showErrorPage(w, r, http.StatusInternalServerError, "Internal server error.", "")
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	buf.WriteTo(w)
 }
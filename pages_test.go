@@ -0,0 +1,291 @@
+package pages
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestServerDevModeReparsesOnEachRequest locks in the chunk0-4 behavior:
+// with DevMode set, each request re-parses templates from the Server's
+// fs.FS, instead of serving the cached template from Add time.
+func TestServerDevModeReparsesOnEachRequest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"base.tmpl": &fstest.MapFile{Data: []byte(`{{define "base"}}v1{{end}}`)},
+	}
+	srv := NewServer(fsys, DevMode())
+	p := srv.Add("/x", func(w http.ResponseWriter, r *http.Request) Result {
+		return StatusOK(nil)
+	}, "base.tmpl")
+
+	rr := httptest.NewRecorder()
+	p.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/x", nil))
+	if got := rr.Body.String(); got != "v1" {
+		t.Fatalf("first request body = %q, want %q", got, "v1")
+	}
+
+	fsys["base.tmpl"].Data = []byte(`{{define "base"}}v2{{end}}`)
+
+	rr2 := httptest.NewRecorder()
+	p.ServeHTTP(rr2, httptest.NewRequest(http.MethodGet, "/x", nil))
+	if got := rr2.Body.String(); got != "v2" {
+		t.Errorf("second request body = %q, want %q (DevMode should re-parse from fsys)", got, "v2")
+	}
+}
+
+// TestServerDevModeParseErrorDegradesToErrorPage locks in the chunk0-4
+// behavior: a template that fails to re-parse during a DevMode request
+// degrades to the 500 error page rather than panicking.
+func TestServerDevModeParseErrorDegradesToErrorPage(t *testing.T) {
+	fsys := fstest.MapFS{
+		"base.tmpl": &fstest.MapFile{Data: []byte(`{{define "base"}}ok{{end}}`)},
+	}
+	srv := NewServer(fsys, DevMode())
+	p := srv.Add("/x", func(w http.ResponseWriter, r *http.Request) Result {
+		return StatusOK(nil)
+	}, "base.tmpl")
+
+	fsys["base.tmpl"].Data = []byte(`{{define "base"}}{{if}}malformed{{end}}`)
+
+	rr := httptest.NewRecorder()
+	p.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/x", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+// TestPageServeHTTPBuffersTemplateExecutionError locks in the chunk0-1
+// behavior: a template that fails partway through execution must not
+// leak its partial output, and the client sees a clean 500 instead.
+func TestPageServeHTTPBuffersTemplateExecutionError(t *testing.T) {
+	tmpl := template.Must(template.New("base").Funcs(template.FuncMap{
+		"boom": func() (string, error) { return "", errors.New("boom") },
+	}).Parse(`partial output{{boom}}`))
+
+	p := Page{
+		URI:  "/boom",
+		tmpl: tmpl,
+		Render: func(w http.ResponseWriter, r *http.Request) Result {
+			return StatusOK(nil)
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	p.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/boom", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if body := rr.Body.String(); strings.Contains(body, "partial output") {
+		t.Errorf("body = %q, should not contain the partially-rendered template output", body)
+	}
+}
+
+// TestShowErrorPageCustomTemplate locks in the chunk0-2 behavior: a
+// registered error template is rendered with an ErrorParams.
+func TestShowErrorPageCustomTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("base").Parse(`custom {{.Code}}: {{.Message}}`))
+	SetErrorTemplate(http.StatusNotFound, tmpl)
+	defer func() {
+		errorTemplatesMu.Lock()
+		delete(errorTemplates, http.StatusNotFound)
+		errorTemplatesMu.Unlock()
+	}()
+
+	rr := httptest.NewRecorder()
+	showErrorPage(rr, httptest.NewRequest(http.MethodGet, "/missing", nil), http.StatusNotFound, "Not found", "")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	if want, got := "custom 404: Not found", rr.Body.String(); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+// TestShowErrorPageFallback locks in the chunk0-2 fallback: with no
+// template registered for a code, showErrorPage degrades to the
+// standard library's plain-text behavior.
+func TestShowErrorPageFallback(t *testing.T) {
+	rr := httptest.NewRecorder()
+	showErrorPage(rr, httptest.NewRequest(http.MethodGet, "/missing", nil), http.StatusNotFound, "Not found", "")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	if !strings.Contains(rr.Body.String(), "404") {
+		t.Errorf("body = %q, want the standard library's plain-text 404 page", rr.Body.String())
+	}
+}
+
+// TestHandlerFuncServeHTTPBuffersOnError locks in the chunk0-6 behavior:
+// output written before a HandlerFunc returns an error must be discarded.
+func TestHandlerFuncServeHTTPBuffersOnError(t *testing.T) {
+	h := HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Write([]byte("partial"))
+		return ErrNotFound
+	})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/x", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	if body := rr.Body.String(); strings.Contains(body, "partial") {
+		t.Errorf("body = %q, should not contain the discarded partial output", body)
+	}
+}
+
+// TestHandlerFuncServeHTTPPublicErrorMessage locks in the chunk0-6
+// behavior: a PublicError's Message is shown to the client, and the
+// wrapped internal error text is not.
+func TestHandlerFuncServeHTTPPublicErrorMessage(t *testing.T) {
+	h := HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return &PublicError{
+			Err:     errors.New("db connection refused at 10.0.0.5:5432"),
+			Message: "Could not load page.",
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/x", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	body := rr.Body.String()
+	if strings.Contains(body, "10.0.0.5") {
+		t.Errorf("body = %q, leaked internal error detail to the client", body)
+	}
+	if !strings.Contains(body, "Could not load page.") {
+		t.Errorf("body = %q, want it to contain the PublicError Message", body)
+	}
+}
+
+// TestHandlerFuncServeHTTPSuccess locks in the chunk0-6 behavior: on a
+// nil error, the buffered response is flushed through unchanged.
+func TestHandlerFuncServeHTTPSuccess(t *testing.T) {
+	h := HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("X-Test", "1")
+		w.Write([]byte("ok"))
+		return nil
+	})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/x", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Body.String(); got != "ok" {
+		t.Errorf("body = %q, want %q", got, "ok")
+	}
+	if got := rr.Header().Get("X-Test"); got != "1" {
+		t.Errorf(`header X-Test = %q, want "1"`, got)
+	}
+}
+
+func TestStatusFor(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{ErrNotFound, http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", ErrNotFound), http.StatusNotFound},
+		{ErrUnauthorized, http.StatusUnauthorized},
+		{ErrBadRequest, http.StatusBadRequest},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if got := statusFor(c.err); got != c.want {
+			t.Errorf("statusFor(%v) = %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+func TestFirstMatchingValidator(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	var calls []string
+	vs := []CaseError{
+		{
+			Validator: func(*http.Request) bool { calls = append(calls, "first"); return false },
+			Msg:       func(*http.Request) string { return "first" },
+		},
+		{
+			Validator: func(*http.Request) bool { calls = append(calls, "second"); return true },
+			Msg:       func(*http.Request) string { return "second" },
+		},
+		{
+			Validator: func(*http.Request) bool { calls = append(calls, "third"); return true },
+			Msg:       func(*http.Request) string { return "third" },
+		},
+	}
+
+	got := firstMatchingValidator(r, vs)
+	if got == nil {
+		t.Fatal("firstMatchingValidator() = nil, want a match")
+	}
+	if msg := got.Msg(r); msg != "second" {
+		t.Errorf("firstMatchingValidator() matched Msg = %q, want %q", msg, "second")
+	}
+	if want := []string{"first", "second"}; !stringSlicesEqual(calls, want) {
+		t.Errorf("firstMatchingValidator() evaluated %v, want to stop after first match %v", calls, want)
+	}
+}
+
+func TestFirstMatchingValidatorNoMatch(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	vs := []CaseError{
+		{Validator: func(*http.Request) bool { return false }},
+		{Validator: func(*http.Request) bool { return false }},
+	}
+	if got := firstMatchingValidator(r, vs); got != nil {
+		t.Errorf("firstMatchingValidator() = %v, want nil", got)
+	}
+}
+
+func TestMergeContext(t *testing.T) {
+	pc := PageContext{User: "alice", Version: "1.2.3", Path: "/a", CSRF: "tok"}
+
+	data := map[string]interface{}{
+		"User":  "bob", // handler already set this; must not be overwritten
+		"Extra": "kept",
+	}
+	mergeContext(data, pc)
+
+	if data["User"] != "bob" {
+		t.Errorf(`data["User"] = %v, want "bob" (handler value should win)`, data["User"])
+	}
+	if data["Version"] != "1.2.3" {
+		t.Errorf(`data["Version"] = %v, want "1.2.3"`, data["Version"])
+	}
+	if data["Path"] != "/a" {
+		t.Errorf(`data["Path"] = %v, want "/a"`, data["Path"])
+	}
+	if data["CSRF"] != "tok" {
+		t.Errorf(`data["CSRF"] = %v, want "tok"`, data["CSRF"])
+	}
+	if data["Extra"] != "kept" {
+		t.Errorf(`data["Extra"] = %v, want "kept"`, data["Extra"])
+	}
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}